@@ -0,0 +1,37 @@
+package cmdg
+
+import (
+	"sync"
+
+	gmail "google.golang.org/api/gmail/v1"
+	people "google.golang.org/api/people/v1"
+)
+
+// CmdG holds the state for one logged-in Gmail account: the
+// authenticated API clients used to talk to Gmail and the People API,
+// plus the contact-completion state derived from them.
+type CmdG struct {
+	m sync.RWMutex
+
+	// email identifies the signed-in account.
+	email string
+
+	// gmail and people are the authenticated API clients used
+	// throughout this package.
+	gmail  *gmail.Service
+	people *people.Service
+
+	// contacts is the flattened completion list served by Contacts.
+	contacts []string
+
+	// contactsCachePath is the on-disk path of the signed-in
+	// account's contact cache, as last loaded or synced.
+	contactsCachePath string
+	// contactsCache is the contact cache as last loaded or synced.
+	// syncContacts and EnrichContacts recompute the path and reload
+	// the cache from disk rather than reading these two fields.
+	contactsCache *contactsCache
+	// identityContacts is the identity-matched, deduplicated view
+	// built from contactsCache, served by GetContacts.
+	identityContacts *Contacts
+}
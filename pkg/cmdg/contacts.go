@@ -3,127 +3,282 @@ package cmdg
 import (
 	"context"
 	"fmt"
-	"regexp"
-	"sort"
+	"mime"
+	"net/mail"
 	"strings"
-	"sync"
-	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
-const (
-	maxContacts      = 10000
-	contactBatchSize = 50
-)
-
-var (
-	// Valid RFC5322 comment field. Actually this is a bit
-	// restrictive since some other chars are allowed per section
-	// 3.2.3. But this is playing it safe for now.
-	rfc5322commentRE = regexp.MustCompile(`^[A-Za-z0-9]+$`)
-)
+// rfc5322specials are the "specials" from RFC 5322 §3.2.3 that force
+// a display-name to be quoted.
+const rfc5322specials = `()<>[]:;@\,."`
 
+// Contacts returns the cached completion list synchronously; it never
+// blocks on network access.
 func (c *CmdG) Contacts() []string {
 	c.m.RLock()
 	defer c.m.RUnlock()
 	return append([]string{"me"}, c.contacts...)
 }
 
+// LoadContacts serves the on-disk contact cache immediately so the UI
+// isn't blocked by a cold-start network round-trip, then syncs with
+// the People API in the background and updates both the cache and the
+// in-memory list when that finishes.
 func (c *CmdG) LoadContacts(ctx context.Context) error {
-	co, err := c.GetContacts(ctx)
+	path, err := contactsCachePath(c.contactsAccount())
+	if err != nil {
+		return err
+	}
+	cache, err := loadContactsCache(path)
+	if err != nil {
+		return err
+	}
+	if err := c.setContactsCacheLocked(path, cache); err != nil {
+		return err
+	}
+
+	// Detach from ctx for the background work: LoadContacts returns
+	// long before this finishes, and a caller that cancels ctx once
+	// LoadContacts returns (e.g. a startup-scoped context) shouldn't
+	// also cut the sync short.
+	bgCtx := context.Background()
+	go func() {
+		if err := c.syncContacts(bgCtx, false); err != nil {
+			log.Warningf("Background contact sync failed: %v", err)
+		}
+		// Other Contacts and frequent Sent recipients are slower to
+		// gather and less important than the user's real contacts, so
+		// they're layered in afterwards instead of delaying startup.
+		if err := c.EnrichContacts(bgCtx, 0); err != nil {
+			log.Warningf("Background contact enrichment failed: %v", err)
+		}
+	}()
+	return nil
+}
+
+// setContactsCacheLocked stores cache, rebuilds the identity-matched
+// view from it and the user's alias overrides, and updates the
+// flattened completion list. It takes c.m itself.
+func (c *CmdG) setContactsCacheLocked(path string, cache *contactsCache) error {
+	aliasCfg, err := loadAliasesConfigForContacts()
 	if err != nil {
 		return err
 	}
+	identity := buildContacts(cache, aliasCfg)
+
 	c.m.Lock()
 	defer c.m.Unlock()
-	c.contacts = co
+	c.contactsCachePath = path
+	c.contactsCache = cache
+	c.identityContacts = identity
+	c.contacts = identity.All()
 	return nil
 }
 
-func quoteNameIfNeeded(s string) string {
-	if rfc5322commentRE.MatchString(s) {
-		return s
+// loadAliasesConfigForContacts loads the user's contact_aliases.yaml
+// overrides, treating a missing file, or a config directory that can't
+// be determined, as "no overrides". A file that exists but can't be
+// read or parsed is returned as an error.
+func loadAliasesConfigForContacts() (*ContactAliasesConfig, error) {
+	path, err := contactAliasesConfigPath()
+	if err != nil {
+		log.Warningf("Finding contact_aliases.yaml path: %v", err)
+		return &ContactAliasesConfig{}, nil
+	}
+	return loadContactAliasesConfig(path)
+}
+
+// RefreshContacts forces a full resync with the People API, discarding
+// any saved sync token, then re-enriches with Other Contacts and Sent
+// frequency (a full resync replaces the whole cache, including the
+// entries those added), and blocks until it all completes.
+func (c *CmdG) RefreshContacts(ctx context.Context) error {
+	if err := c.syncContacts(ctx, true); err != nil {
+		return err
 	}
-	return fmt.Sprintf("%q", s)
+	return c.EnrichContacts(ctx, 0)
 }
 
-// GetContacts gets all contact's email addresses in "Name Name <email@example.com>" format.
-func (c *CmdG) GetContacts(ctx context.Context) ([]string, error) {
-	// List contacts.
-	r, err := c.people.ContactGroups.Get("contactGroups/all").Context(ctx).MaxMembers(maxContacts).Do()
+// contactsAccount identifies the signed-in account for the purpose of
+// keying the on-disk contact cache.
+func (c *CmdG) contactsAccount() string {
+	if c.email != "" {
+		return c.email
+	}
+	return "default"
+}
+
+// syncContacts brings the on-disk cache up to date with the People
+// API, using incremental sync via syncToken unless full is true or no
+// token is stored yet. On success it persists the cache and updates
+// the in-memory completion list.
+func (c *CmdG) syncContacts(ctx context.Context, full bool) error {
+	path, err := contactsCachePath(c.contactsAccount())
 	if err != nil {
-		return nil, err
+		return err
 	}
-	log.Infof("Retrieved %d of %d contacts", len(r.MemberResourceNames), r.MemberCount)
-
-	// Get contact names/email addresses.
-	var wg sync.WaitGroup
-	pchan := make(chan string)
-	batches := len(r.MemberResourceNames)/contactBatchSize + 1
-	perr := make(chan error, batches)
-	for n := 0; ; n++ {
-		start := n * contactBatchSize
-		end := (n + 1) * contactBatchSize
-		if start >= len(r.MemberResourceNames) {
-			break
+	cache, err := loadContactsCache(path)
+	if err != nil {
+		return err
+	}
+	if full {
+		cache = &contactsCache{Contacts: map[string]cachedContact{}}
+	}
+
+	call := c.people.People.Connections.List("people/me").
+		Context(ctx).
+		PersonFields("names,emailAddresses").
+		RequestSyncToken(true)
+	if cache.SyncToken != "" {
+		call = call.SyncToken(cache.SyncToken)
+	}
+	pageToken := ""
+	for {
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
 		}
-		if end > len(r.MemberResourceNames) {
-			end = len(r.MemberResourceNames)
+		r, err := call.Do()
+		if err != nil {
+			if !full && isExpiredSyncToken(err) {
+				log.Infof("Contacts sync token expired, doing full resync")
+				return c.syncContacts(ctx, true)
+			}
+			return err
 		}
-		batch := r.MemberResourceNames[start:end]
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for {
-				p, err := c.people.People.GetBatchGet().Context(ctx).ResourceNames(batch...).PersonFields("names,emailAddresses").Do()
+		for _, p := range r.Connections {
+			if p.Metadata != nil && p.Metadata.Deleted {
+				delete(cache.Contacts, p.ResourceName)
+				continue
+			}
+			name := ""
+			if len(p.Names) > 0 {
+				name = p.Names[0].DisplayName
+			}
+			var addrs []string
+			for _, e := range p.EmailAddresses {
+				addr, addrName, err := parseContactEmailValue(e.Value)
 				if err != nil {
-					log.Warningf("Error loading contacts: %v", err)
-					if strings.Contains(err.Error(), "quota") {
-						time.Sleep(time.Second)
-						continue
-					}
-					perr <- err
-					return
+					log.Warningf("Skipping malformed contact email address %q: %v", e.Value, err)
+					continue
 				}
-				for _, r := range p.Responses {
-					// Use name first listed.
-					name := ""
-					if len(r.Person.Names) > 0 {
-						name = r.Person.Names[0].DisplayName
-					}
-					for _, e := range r.Person.EmailAddresses {
-						if strings.Contains(e.Value, " ") {
-							// Name already there.
-							log.Warningf("Contact email address contains a space: %q", e.Value)
-							pchan <- e.Value
-						} else {
-							if len(name) > 0 {
-								pchan <- fmt.Sprintf(`%s <%s>`, quoteNameIfNeeded(name), e.Value)
-							} else {
-								pchan <- e.Value
-							}
-						}
-					}
+				if name == "" {
+					name = addrName
 				}
-				return
+				addrs = append(addrs, addr)
+			}
+			cache.Contacts[p.ResourceName] = cachedContact{
+				ResourceName:   p.ResourceName,
+				ETag:           p.Etag,
+				DisplayName:    name,
+				EmailAddresses: addrs,
+				Source:         SourceContacts,
 			}
-		}()
+		}
+		if r.NextSyncToken != "" {
+			cache.SyncToken = r.NextSyncToken
+		}
+		if r.NextPageToken == "" {
+			break
+		}
+		pageToken = r.NextPageToken
 	}
-	go func() {
-		wg.Wait()
-		close(pchan)
-		close(perr)
-	}()
-	var ret []string
-	for s := range pchan {
-		ret = append(ret, s)
+
+	if err := saveContactsCache(path, cache); err != nil {
+		return fmt.Errorf("saving contacts cache: %v", err)
 	}
-	for e := range perr {
-		return nil, e
+
+	return c.setContactsCacheLocked(path, cache)
+}
+
+// parseContactEmailValue extracts the bare address (and, if present,
+// a display name) from a People API EmailAddresses[].Value. That
+// value is usually just an address, but the API sometimes already
+// returns a formatted "Name <addr>" string, so an unwrapped parse is
+// tried first before falling back to treating the whole value as a
+// bare address.
+func parseContactEmailValue(value string) (addr, name string, err error) {
+	if a, err := mail.ParseAddress(value); err == nil {
+		return a.Address, a.Name, nil
+	}
+	a, err := mail.ParseAddress(fmt.Sprintf("<%s>", value))
+	if err != nil {
+		return "", "", err
+	}
+	return a.Address, a.Name, nil
+}
+
+// needsQuoting reports whether an RFC 5322 display-name must be
+// quoted: it contains one of the "specials" from §3.2.3, or a
+// control character.
+func needsQuoting(name string) bool {
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f {
+			return true
+		}
 	}
-	sort.Slice(ret, func(i, j int) bool {
-		return strings.TrimLeft(ret[i], `"`) < strings.TrimLeft(ret[j], `"`)
-	})
-	return ret, nil
+	return strings.ContainsAny(name, rfc5322specials)
+}
+
+// quoteDisplayName wraps name in a quoted-string per RFC 5322 §3.2.4,
+// backslash-escaping the characters that require it and replacing
+// ASCII control characters with a \xHH escape rather than passing
+// them through raw: a quoted-string may only carry qtext/quoted-pair,
+// and letting a raw CR or LF survive into the formatted address would
+// let a contact's display name inject extra header lines into
+// outgoing mail.
+func quoteDisplayName(name string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range name {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// formatContact renders name/addr as a single RFC 5322 address,
+// quoting the display name only when the specials set requires it
+// and MIME-encoding it (RFC 2047) when it isn't plain ASCII.
+func formatContact(name, addr string) string {
+	if name == "" {
+		return addr
+	}
+	switch {
+	case !isASCII(name):
+		name = mime.QEncoding.Encode("utf-8", name)
+	case needsQuoting(name):
+		name = quoteDisplayName(name)
+	}
+	return fmt.Sprintf("%s <%s>", name, addr)
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] > 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// GetContacts syncs with the People API and returns the
+// identity-matched, deduplicated view of all contacts. Prefer
+// Contacts for the common case; this forces a network round-trip.
+func (c *CmdG) GetContacts(ctx context.Context) (*Contacts, error) {
+	if err := c.syncContacts(ctx, false); err != nil {
+		return nil, err
+	}
+	c.m.RLock()
+	defer c.m.RUnlock()
+	return c.identityContacts, nil
 }
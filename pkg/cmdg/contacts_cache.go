@@ -0,0 +1,101 @@
+package cmdg
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/api/googleapi"
+)
+
+const contactsCacheFileMode = 0600
+
+// Contact origins, tagging where a cachedContact came from.
+const (
+	SourceContacts      = "contacts"
+	SourceOtherContacts = "other_contacts"
+	SourceSent          = "sent"
+)
+
+// cachedContact is the on-disk representation of a single Person, as
+// returned by the People API (or mined from Sent), sufficient to
+// rebuild the completion list without a network round-trip.
+type cachedContact struct {
+	ResourceName   string   `json:"resourceName"`
+	ETag           string   `json:"etag"`
+	DisplayName    string   `json:"displayName"`
+	EmailAddresses []string `json:"emailAddresses"`
+
+	// Source is one of the Source* constants above.
+	Source string `json:"source,omitempty"`
+	// Frequency is how often this contact's addresses were seen as
+	// recipients in the most recent Sent scan, whatever the Source.
+	Frequency int `json:"frequency,omitempty"`
+}
+
+// contactsCache is the JSON document persisted to
+// ~/.cache/cmdg/contacts-<account>.json. SyncToken lets subsequent
+// loads ask the People API for only what changed since last time.
+type contactsCache struct {
+	SyncToken string                   `json:"syncToken"`
+	Contacts  map[string]cachedContact `json:"contacts"`
+}
+
+// contactsCachePath returns the on-disk path for account's contact
+// cache, creating its parent directory if needed.
+func contactsCachePath(account string) (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("finding user cache dir: %v", err)
+	}
+	dir = filepath.Join(dir, "cmdg")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("creating cache dir %q: %v", dir, err)
+	}
+	return filepath.Join(dir, fmt.Sprintf("contacts-%s.json", account)), nil
+}
+
+// loadContactsCache reads the cache from disk. A missing file is not
+// an error; it just means a full sync is needed.
+func loadContactsCache(path string) (*contactsCache, error) {
+	st, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &contactsCache{Contacts: map[string]cachedContact{}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cc contactsCache
+	if err := json.Unmarshal(st, &cc); err != nil {
+		return nil, fmt.Errorf("parsing contacts cache %q: %v", path, err)
+	}
+	if cc.Contacts == nil {
+		cc.Contacts = map[string]cachedContact{}
+	}
+	return &cc, nil
+}
+
+func saveContactsCache(path string, cc *contactsCache) error {
+	st, err := json.Marshal(cc)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, st, contactsCacheFileMode); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// isExpiredSyncToken reports whether err is the People API's way of
+// telling us the stored sync token is too old to resume from, which
+// means we must discard it and do a full resync.
+func isExpiredSyncToken(err error) bool {
+	gerr, ok := err.(*googleapi.Error)
+	if !ok {
+		return false
+	}
+	return gerr.Code == 400 && strings.Contains(strings.ToLower(gerr.Message), "sync token")
+}
@@ -0,0 +1,288 @@
+package cmdg
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// honorifics are stripped from the front of a display name before
+// comparing it to another name for identity matching.
+var honorifics = []string{"mr.", "mrs.", "ms.", "dr.", "prof."}
+
+// normalizeAddress canonicalizes an email address for identity
+// matching: lowercase, strip a "+suffix" from the localpart, and for
+// Gmail domains drop the dots Google itself ignores there.
+func normalizeAddress(addr string) string {
+	addr = strings.ToLower(strings.TrimSpace(addr))
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
+		return addr
+	}
+	local, domain := addr[:at], addr[at+1:]
+	if i := strings.IndexByte(local, '+'); i >= 0 {
+		local = local[:i]
+	}
+	if domain == "gmail.com" || domain == "googlemail.com" {
+		local = strings.ReplaceAll(local, ".", "")
+	}
+	return local + "@" + domain
+}
+
+// normalizeDisplayName casefolds name and strips a leading honorific,
+// so that e.g. "Dr. Jane Doe" matches "Jane Doe".
+func normalizeDisplayName(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for _, h := range honorifics {
+		if rest := strings.TrimPrefix(name, h+" "); rest != name {
+			name = rest
+			break
+		}
+	}
+	return name
+}
+
+// disjointSet is a union-find over contact resourceNames, used to
+// group contacts that refer to the same real-world person.
+type disjointSet struct {
+	parent map[string]string
+}
+
+func newDisjointSet() *disjointSet {
+	return &disjointSet{parent: map[string]string{}}
+}
+
+func (d *disjointSet) find(x string) string {
+	if _, ok := d.parent[x]; !ok {
+		d.parent[x] = x
+		return x
+	}
+	if d.parent[x] != x {
+		d.parent[x] = d.find(d.parent[x])
+	}
+	return d.parent[x]
+}
+
+func (d *disjointSet) union(a, b string) {
+	ra, rb := d.find(a), d.find(b)
+	if ra != rb {
+		d.parent[ra] = rb
+	}
+}
+
+// ContactAliasesConfig lets the user correct identity matching by
+// hand: force two addresses to be treated as the same person, or
+// forbid an automatic merge that got it wrong. It's loaded from
+// contact_aliases.yaml in the user's config directory.
+type ContactAliasesConfig struct {
+	Merge  [][]string `yaml:"merge"`
+	Forbid [][]string `yaml:"forbid"`
+}
+
+func contactAliasesConfigPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "cmdg", "contact_aliases.yaml"), nil
+}
+
+// loadContactAliasesConfig reads the user's override file. A missing
+// file just means there are no overrides.
+func loadContactAliasesConfig(path string) (*ContactAliasesConfig, error) {
+	st, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &ContactAliasesConfig{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cfg ContactAliasesConfig
+	if err := yaml.Unmarshal(st, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing %q: %v", path, err)
+	}
+	return &cfg, nil
+}
+
+// Contacts is a deduplicated, identity-matched view of the contact
+// cache: each real-world person appears once, as a primary "Name
+// <addr>" entry, with their other known addresses attached as
+// aliases.
+type Contacts struct {
+	primaries []string
+	aliases   map[string][]string
+	freq      map[string]int // formatted entry -> Sent frequency
+}
+
+// All returns every primary and alias, flattened into one sorted
+// list, for callers that just want a flat completion list.
+func (c *Contacts) All() []string {
+	ret := append([]string{}, c.primaries...)
+	for _, p := range c.primaries {
+		ret = append(ret, c.aliases[p]...)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Primary returns one entry per identity-matched person.
+func (c *Contacts) Primary() []string {
+	return append([]string{}, c.primaries...)
+}
+
+// Aliases returns the other addresses known for the person behind
+// primary (as returned by Primary), if any.
+func (c *Contacts) Aliases(primary string) []string {
+	return append([]string{}, c.aliases[primary]...)
+}
+
+// ByFrequency returns the same entries as All, but with entries mined
+// from Sent ranked above alphabetical order, most-frequently-mailed
+// first.
+func (c *Contacts) ByFrequency() []string {
+	ret := c.All()
+	sort.SliceStable(ret, func(i, j int) bool {
+		return c.freq[ret[i]] > c.freq[ret[j]]
+	})
+	return ret
+}
+
+// buildContacts groups cache's contacts by real-world identity and
+// picks a canonical primary entry for each group, honoring cfg's
+// manual overrides.
+func buildContacts(cache *contactsCache, cfg *ContactAliasesConfig) *Contacts {
+	ds := newDisjointSet()
+	byAddr := map[string][]string{} // normalized address -> resourceNames
+	byName := map[string][]string{} // normalized display name -> resourceNames
+
+	for rn, co := range cache.Contacts {
+		ds.find(rn)
+		for _, addr := range co.EmailAddresses {
+			na := normalizeAddress(addr)
+			byAddr[na] = append(byAddr[na], rn)
+		}
+		if nn := normalizeDisplayName(co.DisplayName); nn != "" {
+			byName[nn] = append(byName[nn], rn)
+		}
+	}
+
+	forbidden := resolveAliasPairs(cfg.Forbid, byAddr)
+	for _, group := range byAddr {
+		unionGroupExcept(ds, group, forbidden)
+	}
+	for _, group := range byName {
+		unionGroupExcept(ds, group, forbidden)
+	}
+	for _, pair := range resolveAliasPairs(cfg.Merge, byAddr) {
+		ds.union(pair[0], pair[1])
+	}
+
+	clusters := map[string][]string{}
+	for rn := range cache.Contacts {
+		root := ds.find(rn)
+		clusters[root] = append(clusters[root], rn)
+	}
+
+	cs := &Contacts{aliases: map[string][]string{}, freq: map[string]int{}}
+	for _, members := range clusters {
+		type addrName struct {
+			addr string
+			freq int
+		}
+		var addrs []addrName
+		canonical := ""
+		for _, rn := range members {
+			co := cache.Contacts[rn]
+			if len(co.DisplayName) > len(canonical) {
+				canonical = co.DisplayName
+			}
+			for _, a := range co.EmailAddresses {
+				addrs = append(addrs, addrName{a, co.Frequency})
+			}
+		}
+		if len(addrs) == 0 {
+			continue
+		}
+		sort.Slice(addrs, func(i, j int) bool { return addrs[i].addr < addrs[j].addr })
+		primary := formatContact(canonical, addrs[0].addr)
+		cs.primaries = append(cs.primaries, primary)
+		cs.freq[primary] = addrs[0].freq
+		for _, a := range addrs[1:] {
+			entry := formatContact(canonical, a.addr)
+			cs.aliases[primary] = append(cs.aliases[primary], entry)
+			cs.freq[entry] = a.freq
+		}
+	}
+	sort.Strings(cs.primaries)
+	return cs
+}
+
+// resolveAliasPairs maps [addr1, addr2] pairs from the aliases config
+// to the resourceName pairs they refer to, for addresses that are
+// actually present in byAddr.
+func resolveAliasPairs(pairs [][]string, byAddr map[string][]string) [][2]string {
+	var ret [][2]string
+	for _, pair := range pairs {
+		if len(pair) != 2 {
+			continue
+		}
+		as, ok1 := byAddr[normalizeAddress(pair[0])]
+		bs, ok2 := byAddr[normalizeAddress(pair[1])]
+		if !ok1 || !ok2 {
+			continue
+		}
+		for _, a := range as {
+			for _, b := range bs {
+				ret = append(ret, [2]string{a, b})
+			}
+		}
+	}
+	return ret
+}
+
+// unionGroupExcept unions every resourceName in group together,
+// skipping any union that would place a pair the user has explicitly
+// forbidden into the same cluster. Checking every pair (rather than
+// just a star from group[0]) matters because a forbidden pair can
+// otherwise still end up merged transitively through a third member
+// they both share this group with. group is sorted first so the
+// result doesn't depend on the random map iteration order callers
+// build it from.
+func unionGroupExcept(ds *disjointSet, group []string, forbidden [][2]string) {
+	sort.Strings(group)
+	for i := 0; i < len(group); i++ {
+		for j := i + 1; j < len(group); j++ {
+			if wouldMergeForbiddenPair(ds, group[i], group[j], forbidden) {
+				continue
+			}
+			ds.union(group[i], group[j])
+		}
+	}
+}
+
+// wouldMergeForbiddenPair reports whether unioning a and b would put
+// both members of some forbidden pair into the same cluster, whether
+// directly or transitively through clusters a and b already belong
+// to.
+func wouldMergeForbiddenPair(ds *disjointSet, a, b string, forbidden [][2]string) bool {
+	ra, rb := ds.find(a), ds.find(b)
+	if ra == rb {
+		return false
+	}
+	mergedRoot := func(r string) string {
+		if r == ra || r == rb {
+			return ra
+		}
+		return r
+	}
+	for _, f := range forbidden {
+		if mergedRoot(ds.find(f[0])) == mergedRoot(ds.find(f[1])) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,158 @@
+package cmdg
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestBuildContactsMergesByAddressAndName(t *testing.T) {
+	cache := &contactsCache{
+		Contacts: map[string]cachedContact{
+			"people/1": {
+				ResourceName:   "people/1",
+				DisplayName:    "Jane Doe",
+				EmailAddresses: []string{"jane.doe+work@gmail.com"},
+			},
+			"people/2": {
+				ResourceName:   "people/2",
+				DisplayName:    "Jane Doe",
+				EmailAddresses: []string{"janedoe@gmail.com"},
+			},
+			"people/3": {
+				ResourceName:   "people/3",
+				DisplayName:    "John Smith",
+				EmailAddresses: []string{"john@example.com"},
+			},
+		},
+	}
+	cs := buildContacts(cache, &ContactAliasesConfig{})
+
+	if got, want := len(cs.Primary()), 2; got != want {
+		t.Fatalf("Primary() returned %d entries, want %d: %v", got, want, cs.Primary())
+	}
+
+	const jane = "Jane Doe <jane.doe+work@gmail.com>"
+	found := false
+	for _, p := range cs.Primary() {
+		if p == jane {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("did not find merged Jane Doe primary in %v", cs.Primary())
+	}
+	if got, want := cs.Aliases(jane), []string{"Jane Doe <janedoe@gmail.com>"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Aliases(%q) = %v, want %v", jane, got, want)
+	}
+
+	all := cs.All()
+	sort.Strings(all)
+	want := []string{"Jane Doe <jane.doe+work@gmail.com>", "Jane Doe <janedoe@gmail.com>", "John Smith <john@example.com>"}
+	if !reflect.DeepEqual(all, want) {
+		t.Errorf("All() = %v, want %v", all, want)
+	}
+}
+
+func TestBuildContactsForbidOverridesAutoMerge(t *testing.T) {
+	cache := &contactsCache{
+		Contacts: map[string]cachedContact{
+			"people/1": {
+				ResourceName:   "people/1",
+				DisplayName:    "Pat Lee",
+				EmailAddresses: []string{"pat@example.com"},
+			},
+			"people/2": {
+				ResourceName:   "people/2",
+				DisplayName:    "Pat Lee",
+				EmailAddresses: []string{"pat2@example.com"},
+			},
+		},
+	}
+	cfg := &ContactAliasesConfig{
+		Forbid: [][]string{{"pat@example.com", "pat2@example.com"}},
+	}
+	cs := buildContacts(cache, cfg)
+	if got, want := len(cs.Primary()), 2; got != want {
+		t.Fatalf("Primary() returned %d entries, want %d: %v", got, want, cs.Primary())
+	}
+}
+
+func TestBuildContactsForbidSurvivesTransitiveMerge(t *testing.T) {
+	// pat1, pat2 and pat3 all share the display name "Pat Lee", so
+	// without the forbid they'd all end up in one cluster. Forbidding
+	// pat2/pat3 must keep those two apart even though neither is the
+	// group's sorted-first (hub) member.
+	cache := &contactsCache{
+		Contacts: map[string]cachedContact{
+			"people/1": {
+				ResourceName:   "people/1",
+				DisplayName:    "Pat Lee",
+				EmailAddresses: []string{"pat1@example.com"},
+			},
+			"people/2": {
+				ResourceName:   "people/2",
+				DisplayName:    "Pat Lee",
+				EmailAddresses: []string{"pat2@example.com"},
+			},
+			"people/3": {
+				ResourceName:   "people/3",
+				DisplayName:    "Pat Lee",
+				EmailAddresses: []string{"pat3@example.com"},
+			},
+		},
+	}
+	cfg := &ContactAliasesConfig{
+		Forbid: [][]string{{"pat2@example.com", "pat3@example.com"}},
+	}
+	cs := buildContacts(cache, cfg)
+
+	var pat2Primary, pat3Primary string
+	for _, p := range cs.Primary() {
+		if p == "Pat Lee <pat2@example.com>" || contains(cs.Aliases(p), "Pat Lee <pat2@example.com>") {
+			pat2Primary = p
+		}
+		if p == "Pat Lee <pat3@example.com>" || contains(cs.Aliases(p), "Pat Lee <pat3@example.com>") {
+			pat3Primary = p
+		}
+	}
+	if pat2Primary == "" || pat3Primary == "" {
+		t.Fatalf("could not find pat2/pat3 in %v", cs.Primary())
+	}
+	if pat2Primary == pat3Primary {
+		t.Errorf("forbidden pair pat2/pat3 ended up in the same cluster (primary %q)", pat2Primary)
+	}
+}
+
+func contains(s []string, v string) bool {
+	for _, x := range s {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+func TestContactsByFrequency(t *testing.T) {
+	cache := &contactsCache{
+		Contacts: map[string]cachedContact{
+			"people/1": {
+				ResourceName:   "people/1",
+				DisplayName:    "Alice",
+				EmailAddresses: []string{"alice@example.com"},
+			},
+			"sent/bob@example.com": {
+				ResourceName:   "sent/bob@example.com",
+				DisplayName:    "Bob",
+				EmailAddresses: []string{"bob@example.com"},
+				Source:         SourceSent,
+				Frequency:      42,
+			},
+		},
+	}
+	cs := buildContacts(cache, &ContactAliasesConfig{})
+	got := cs.ByFrequency()
+	if len(got) != 2 || got[0] != "Bob <bob@example.com>" {
+		t.Errorf("ByFrequency() = %v, want Bob ranked first", got)
+	}
+}
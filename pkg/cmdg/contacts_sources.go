@@ -0,0 +1,270 @@
+package cmdg
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultSentScanLimit bounds how many Sent messages EnrichContacts
+// scans for frequent correspondents when the caller doesn't ask for a
+// specific limit.
+const defaultSentScanLimit = 1000
+
+// sentScanPageSize is the Gmail List page size used while scanning
+// Sent; it's independent of sentScanLimit, which caps the total
+// number of messages inspected.
+const sentScanPageSize = 100
+
+// sentScanConcurrency bounds how many Messages.Get calls run at once
+// while scanning Sent, the same way GetContacts used to parallelize
+// its People.GetBatchGet calls.
+const sentScanConcurrency = 10
+
+// recipient is a single To/Cc/Bcc address seen in a Sent message,
+// with the display name the sender used for it, if any.
+type recipient struct {
+	addr string
+	name string
+}
+
+// EnrichContacts layers Gmail's "Other Contacts" and frequently
+// emailed addresses mined from the last sentScanLimit Sent messages
+// (defaultSentScanLimit if <= 0) on top of the cached contacts,
+// tagging each with its origin so completion can rank them. It's
+// meant to run after the initial People sync, since it's slower and
+// not required before the UI can show completions.
+func (c *CmdG) EnrichContacts(ctx context.Context, sentScanLimit int) error {
+	path, err := contactsCachePath(c.contactsAccount())
+	if err != nil {
+		return err
+	}
+	cache, err := loadContactsCache(path)
+	if err != nil {
+		return err
+	}
+
+	if err := c.mergeOtherContacts(ctx, cache); err != nil {
+		log.Warningf("Loading other contacts: %v", err)
+	}
+
+	if sentScanLimit <= 0 {
+		sentScanLimit = defaultSentScanLimit
+	}
+	if err := c.mergeSentFrequency(ctx, cache, sentScanLimit); err != nil {
+		log.Warningf("Scanning Sent for frequent correspondents: %v", err)
+	}
+
+	if err := saveContactsCache(path, cache); err != nil {
+		return fmt.Errorf("saving contacts cache: %v", err)
+	}
+	return c.setContactsCacheLocked(path, cache)
+}
+
+// addressIndex maps every normalized address already present in cache
+// to the resourceName that owns it, so newly-merged sources can skip
+// addresses that are already known or fold data into the existing
+// entry instead of duplicating it.
+func addressIndex(cache *contactsCache) map[string]string {
+	index := map[string]string{}
+	for rn, co := range cache.Contacts {
+		for _, addr := range co.EmailAddresses {
+			index[normalizeAddress(addr)] = rn
+		}
+	}
+	return index
+}
+
+// mergeOtherContacts fetches people.OtherContacts.List (the people the
+// user has emailed but never explicitly added) and merges any address
+// not already known into cache.
+func (c *CmdG) mergeOtherContacts(ctx context.Context, cache *contactsCache) error {
+	known := addressIndex(cache)
+	pageToken := ""
+	for {
+		call := c.people.OtherContacts.List().Context(ctx).ReadMask("emailAddresses,names")
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
+		}
+		r, err := call.Do()
+		if err != nil {
+			return err
+		}
+		for _, p := range r.OtherContacts {
+			name := ""
+			if len(p.Names) > 0 {
+				name = p.Names[0].DisplayName
+			}
+			var addrs []string
+			for _, e := range p.EmailAddresses {
+				addr, addrName, err := parseContactEmailValue(e.Value)
+				if err != nil {
+					log.Warningf("Skipping malformed other-contact email address %q: %v", e.Value, err)
+					continue
+				}
+				if name == "" {
+					name = addrName
+				}
+				if _, ok := known[normalizeAddress(addr)]; ok {
+					continue
+				}
+				addrs = append(addrs, addr)
+			}
+			if len(addrs) == 0 {
+				continue
+			}
+			cache.Contacts[p.ResourceName] = cachedContact{
+				ResourceName:   p.ResourceName,
+				ETag:           p.Etag,
+				DisplayName:    name,
+				EmailAddresses: addrs,
+				Source:         SourceOtherContacts,
+			}
+		}
+		if r.NextPageToken == "" {
+			return nil
+		}
+		pageToken = r.NextPageToken
+	}
+}
+
+// mergeSentFrequency scans at most limit of the user's Sent messages,
+// tallying how often each To/Cc/Bcc address appears. An address that
+// already belongs to a known contact or Other Contact has its
+// Frequency updated in place, so frequency ranking covers every
+// source rather than just addresses that were previously unknown;
+// addresses seen only in Sent are added as new SourceSent entries.
+// The Messages.Get calls run sentScanConcurrency at a time, the same
+// way GetContacts used to parallelize its People.GetBatchGet calls.
+func (c *CmdG) mergeSentFrequency(ctx context.Context, cache *contactsCache, limit int) error {
+	known := addressIndex(cache)
+
+	ids, err := c.listSentMessageIDs(ctx, limit)
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, sentScanConcurrency)
+	rchan := make(chan []recipient, len(ids))
+	for _, id := range ids {
+		id := id
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			rchan <- c.fetchSentRecipients(ctx, id)
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(rchan)
+	}()
+
+	counts := map[string]int{}
+	names := map[string]string{}
+	rawAddr := map[string]string{} // normalized -> address as it actually appeared
+	for recipients := range rchan {
+		for _, r := range recipients {
+			na := normalizeAddress(r.addr)
+			counts[na]++
+			if r.name != "" {
+				names[na] = r.name
+			}
+			if _, ok := rawAddr[na]; !ok {
+				rawAddr[na] = r.addr
+			}
+		}
+	}
+
+	// Each scan counts from scratch, replacing earlier scans' counts.
+	for rn, co := range cache.Contacts {
+		co.Frequency = 0
+		cache.Contacts[rn] = co
+	}
+	for na, n := range counts {
+		if rn, ok := known[na]; ok {
+			co := cache.Contacts[rn]
+			co.Frequency += n
+			cache.Contacts[rn] = co
+			continue
+		}
+		cache.Contacts["sent/"+na] = cachedContact{
+			ResourceName:   "sent/" + na,
+			DisplayName:    names[na],
+			EmailAddresses: []string{rawAddr[na]},
+			Source:         SourceSent,
+			Frequency:      n,
+		}
+	}
+	return nil
+}
+
+// listSentMessageIDs returns up to limit message IDs from the Sent
+// mailbox, newest first.
+func (c *CmdG) listSentMessageIDs(ctx context.Context, limit int) ([]string, error) {
+	var ids []string
+	pageToken := ""
+	for len(ids) < limit {
+		call := c.gmail.Users.Messages.List("me").Context(ctx).Q("in:sent").MaxResults(sentScanPageSize)
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
+		}
+		r, err := call.Do()
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range r.Messages {
+			if len(ids) >= limit {
+				break
+			}
+			ids = append(ids, m.Id)
+		}
+		if r.NextPageToken == "" {
+			break
+		}
+		pageToken = r.NextPageToken
+	}
+	return ids, nil
+}
+
+// fetchSentRecipients fetches the To/Cc/Bcc headers of a single Sent
+// message and parses out its recipients. Fetch errors are logged and
+// treated as "no recipients", since a handful of unreadable messages
+// shouldn't abort the whole scan.
+func (c *CmdG) fetchSentRecipients(ctx context.Context, id string) []recipient {
+	msg, err := c.gmail.Users.Messages.Get("me", id).Context(ctx).Format("metadata").MetadataHeaders("To", "Cc", "Bcc").Do()
+	if err != nil {
+		log.Warningf("Fetching sent message %s: %v", id, err)
+		return nil
+	}
+	if msg.Payload == nil {
+		return nil
+	}
+	var recipients []recipient
+	for _, h := range msg.Payload.Headers {
+		switch h.Name {
+		case "To", "Cc", "Bcc":
+			recipients = append(recipients, parseRecipients(h.Value)...)
+		}
+	}
+	return recipients
+}
+
+// parseRecipients parses a To/Cc/Bcc header value, which may list
+// several comma-separated addresses.
+func parseRecipients(header string) []recipient {
+	addrs, err := mail.ParseAddressList(header)
+	if err != nil {
+		return nil
+	}
+	ret := make([]recipient, len(addrs))
+	for i, a := range addrs {
+		ret[i] = recipient{addr: a.Address, name: a.Name}
+	}
+	return ret
+}
@@ -0,0 +1,48 @@
+package cmdg
+
+import "testing"
+
+func TestParseContactEmailValue(t *testing.T) {
+	for _, test := range []struct {
+		value    string
+		wantAddr string
+		wantName string
+		wantErr  bool
+	}{
+		{"foo@example.com", "foo@example.com", "", false},
+		{"Jane Doe <jane@example.com>", "jane@example.com", "Jane Doe", false},
+		{"not an address", "", "", true},
+	} {
+		addr, name, err := parseContactEmailValue(test.value)
+		if (err != nil) != test.wantErr {
+			t.Errorf("parseContactEmailValue(%q) error = %v, wantErr %v", test.value, err, test.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if addr != test.wantAddr || name != test.wantName {
+			t.Errorf("parseContactEmailValue(%q) = (%q, %q), want (%q, %q)", test.value, addr, name, test.wantAddr, test.wantName)
+		}
+	}
+}
+
+func TestFormatContact(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		addr string
+		want string
+	}{
+		{"Foo Bar", "foo@example.com", "Foo Bar <foo@example.com>"},
+		{"Bar, Foo", "foo@example.com", `"Bar, Foo" <foo@example.com>`},
+		{`Foo "The Man" Bar`, "foo@example.com", `"Foo \"The Man\" Bar" <foo@example.com>`},
+		{"Foo.Bar", "foo@example.com", `"Foo.Bar" <foo@example.com>`},
+		{"Fooé Bar", "foo@example.com", "=?utf-8?q?Foo=C3=A9_Bar?= <foo@example.com>"},
+		{"", "foo@example.com", "foo@example.com"},
+		{"Evil\r\nBcc: attacker@evil.com", "a@b.com", `"Evil\x0d\x0aBcc: attacker@evil.com" <a@b.com>`},
+	} {
+		if got := formatContact(test.name, test.addr); got != test.want {
+			t.Errorf("formatContact(%q, %q) = %q, want %q", test.name, test.addr, got, test.want)
+		}
+	}
+}